@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ActiveUserRow is a single row of the active_users data, used as the common shape fed
+// into each export format
+type ActiveUserRow struct {
+	Date    string `json:"date"`
+	Country string `json:"country"`
+	Users   int    `json:"users"`
+}
+
+// exportActiveUsers writes the active_users data out in whichever formats are enabled
+// under [export]. Multiple formats can be enabled at once.
+func exportActiveUsers(rows []ActiveUserRow, conf ExportInfo) error {
+	if conf.JSONFile != "" {
+		if err := exportJSON(rows, conf.JSONFile); err != nil {
+			return fmt.Errorf("exporting JSON: %v", err)
+		}
+	}
+	if conf.CSVFile != "" {
+		if err := exportCSV(rows, conf.CSVFile); err != nil {
+			return fmt.Errorf("exporting CSV: %v", err)
+		}
+	}
+	if conf.PromFile != "" {
+		if err := exportProm(rows, conf.PromFile); err != nil {
+			return fmt.Errorf("exporting Prometheus textfile: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeAtomic writes to path by first writing to a temp file in the same directory, then
+// renaming it into place, so a reader (e.g. the node_exporter textfile collector) never
+// sees a partially-written file
+func writeAtomic(path string, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// exportJSON writes rows as newline-delimited JSON: {date, country, users} per line
+func exportJSON(rows []ActiveUserRow, path string) error {
+	return writeAtomic(path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		for _, r := range rows {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// exportCSV writes rows as CSV, with a header row
+func exportCSV(rows []ActiveUserRow, path string) error {
+	return writeAtomic(path, func(f *os.File) error {
+		w := csv.NewWriter(f)
+		if err := w.Write([]string{"date", "country", "users"}); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := w.Write([]string{r.Date, r.Country, fmt.Sprintf("%d", r.Users)}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// exportProm writes rows as a node_exporter textfile-collector-compatible .prom file
+func exportProm(rows []ActiveUserRow, path string) error {
+	return writeAtomic(path, func(f *os.File) error {
+		if _, err := fmt.Fprintln(f, "# HELP db4s_active_users Active DB Browser for SQLite users by country and date"); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(f, "# TYPE db4s_active_users gauge"); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if _, err := fmt.Fprintf(f, "db4s_active_users{country=%q,date=%q} %d\n", r.Country, r.Date, r.Users); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
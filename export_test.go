@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRows = []ActiveUserRow{
+	{Date: "2024-01-01", Country: "USA", Users: 5},
+	{Date: "2024-01-01", Country: "GBR", Users: 2},
+}
+
+func TestExportJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	if err := exportJSON(testRows, path); err != nil {
+		t.Fatalf("exportJSON: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) != len(testRows) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(testRows))
+	}
+	for i, line := range lines {
+		var r ActiveUserRow
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("unmarshalling line %d (%q): %v", i, line, err)
+		}
+		if r != testRows[i] {
+			t.Fatalf("line %d = %+v, want %+v", i, r, testRows[i])
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.csv")
+	if err := exportCSV(testRows, path); err != nil {
+		t.Fatalf("exportCSV: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	if len(records) != len(testRows)+1 {
+		t.Fatalf("got %d records (including header), want %d", len(records), len(testRows)+1)
+	}
+	if got, want := records[0], []string{"date", "country", "users"}; !equalStrings(got, want) {
+		t.Fatalf("header = %v, want %v", got, want)
+	}
+	if got, want := records[1], []string{"2024-01-01", "USA", "5"}; !equalStrings(got, want) {
+		t.Fatalf("row 1 = %v, want %v", got, want)
+	}
+}
+
+func TestExportProm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.prom")
+	if err := exportProm(testRows, path); err != nil {
+		t.Fatalf("exportProm: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	out := string(data)
+	if !strings.Contains(out, "# TYPE db4s_active_users gauge") {
+		t.Fatalf("missing TYPE line:\n%s", out)
+	}
+	want := `db4s_active_users{country="USA",date="2024-01-01"} 5`
+	if !strings.Contains(out, want) {
+		t.Fatalf("missing metric line %q in:\n%s", want, out)
+	}
+}
+
+// TestExportActiveUsersOnlyWritesConfiguredFormats checks that leaving a format's file
+// path blank in [export] disables it, rather than writing to an empty path
+func TestExportActiveUsersOnlyWritesConfiguredFormats(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "out.json")
+
+	if err := exportActiveUsers(testRows, ExportInfo{JSONFile: jsonPath}); err != nil {
+		t.Fatalf("exportActiveUsers: %v", err)
+	}
+
+	if _, err := os.Stat(jsonPath); err != nil {
+		t.Fatalf("expected %s to be written: %v", jsonPath, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.csv")); !os.IsNotExist(err) {
+		t.Fatalf("CSV file should not have been written when CSVFile is unset")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoLookup is what a single source IP resolves to via the GeoIP databases
+type geoLookup struct {
+	continent   string
+	subdivision string
+	asn         string
+}
+
+// geoipEnricher resolves source IPs to continent, subdivision, and ASN using the
+// configured MaxMind GeoLite2 City and ASN databases
+type geoipEnricher struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+// newGeoIPEnricher opens the City and ASN mmdb files configured under [geoip]
+func newGeoIPEnricher(conf GeoIPInfo) (*geoipEnricher, error) {
+	city, err := geoip2.Open(conf.CityDB)
+	if err != nil {
+		return nil, fmt.Errorf("opening GeoIP city database: %v", err)
+	}
+
+	asn, err := geoip2.Open(conf.ASNDB)
+	if err != nil {
+		city.Close()
+		return nil, fmt.Errorf("opening GeoIP ASN database: %v", err)
+	}
+
+	return &geoipEnricher{city: city, asn: asn}, nil
+}
+
+// lookup resolves a single source IP to its continent, subdivision, and ASN
+func (g *geoipEnricher) lookup(ipStr string) (geoLookup, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return geoLookup{}, fmt.Errorf("invalid source IP address: %s", ipStr)
+	}
+
+	city, err := g.city.City(ip)
+	if err != nil {
+		return geoLookup{}, err
+	}
+	asnRecord, err := g.asn.ASN(ip)
+	if err != nil {
+		return geoLookup{}, err
+	}
+
+	var subdivision string
+	if len(city.Subdivisions) > 0 {
+		subdivision = city.Subdivisions[0].IsoCode
+	}
+
+	return geoLookup{
+		continent:   city.Continent.Code,
+		subdivision: subdivision,
+		asn:         fmt.Sprintf("AS%d", asnRecord.AutonomousSystemNumber),
+	}, nil
+}
+
+// Close releases both of the underlying mmdb files
+func (g *geoipEnricher) Close() error {
+	if err := g.city.Close(); err != nil {
+		return err
+	}
+	return g.asn.Close()
+}
@@ -1,22 +1,53 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
-	sqlite "github.com/gwenn/gosqlite"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/jackc/pgx"
 	"github.com/mitchellh/go-homedir"
 )
 
 // Configuration file
 type TomlConfig struct {
-	Pg PGInfo
+	Export ExportInfo
+	GeoIP  GeoIPInfo
+	Output OutputInfo
+	Pg     PGInfo
+	Run    RunInfo
+}
+
+// ExportInfo configures the extra output formats the active_users data can be written to,
+// alongside the main output store. Leaving a field blank disables that format.
+type ExportInfo struct {
+	JSONFile string `toml:"json_file"`
+	CSVFile  string `toml:"csv_file"`
+	PromFile string `toml:"prom_file"`
+}
+
+// GeoIPInfo configures the optional GeoIP enrichment subsystem.  When enabled, each
+// row's source IP is resolved against the configured MaxMind GeoLite2 databases to
+// produce continent, subdivision, and ASN rollups alongside the country counts.
+type GeoIPInfo struct {
+	Enabled  bool   `toml:"enabled"`
+	CityDB   string `toml:"city_db"`
+	ASNDB    string `toml:"asn_db"`
+	IPColumn string `toml:"ip_column"`
+}
+
+// RunInfo controls whether a run recomputes the full history or resumes from where the
+// previous run left off
+type RunInfo struct {
+	Mode string `toml:"mode"`
 }
 type PGInfo struct {
 	Database       string
@@ -28,6 +59,32 @@ type PGInfo struct {
 	Username       string
 }
 
+// OutputInfo selects and configures the Store the generated stats are written to
+type OutputInfo struct {
+	Driver   string `toml:"driver"`
+	SQLite   SQLiteInfo
+	Postgres PostgresDSN
+	MySQL    MySQLInfo
+}
+type SQLiteInfo struct {
+	File string
+}
+type PostgresDSN struct {
+	Database string
+	Port     int
+	Password string
+	Server   string
+	SSL      bool
+	Username string
+}
+type MySQLInfo struct {
+	Database string
+	Port     int
+	Password string
+	Server   string
+	Username string
+}
+
 var (
 	// Application config
 	Conf TomlConfig
@@ -38,11 +95,169 @@ var (
 	// PostgreSQL Connection pool
 	pg *pgx.ConnPool
 
-	// SQLite pieces
-	sdb *sqlite.Conn
+	// Output store for the generated stats
+	store Store
+
+	// GeoIP enrichment subsystem, nil when disabled
+	geo *geoipEnricher
+
+	// Transaction options used for every read-only query against download_log, so each
+	// worker sees a consistent, repeatable snapshot of the table regardless of how many
+	// other workers are querying it concurrently
+	snapshotTxOptions = pgx.TxOptions{
+		IsoLevel:       pgx.Serializable,
+		AccessMode:     pgx.ReadOnly,
+		DeferrableMode: pgx.Deferrable,
+	}
 )
 
+// dayResult holds the per-country active user counts computed for a single day, plus the
+// continent/subdivision/ASN rollups when GeoIP enrichment is enabled
+type dayResult struct {
+	date              time.Time
+	counts            map[string]int
+	continentCounts   map[string]int
+	subdivisionCounts map[string]int
+	asnCounts         map[string]int
+}
+
+// countWorker pulls dates from the dates channel, queries the active user counts for
+// each one from its own PostgreSQL connection/transaction, and sends the result onward
+// for writing. It runs until the dates channel is closed or an error occurs.
+func countWorker(ctx context.Context, dates <-chan time.Time, results chan<- dayResult, errCh chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for queryDate := range dates {
+		r, err := countDay(ctx, queryDate)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		results <- r
+	}
+}
+
+// countDay queries the active user counts (and GeoIP rollups, if enabled) for a single
+// day from its own snapshot transaction. The transaction is always rolled back via defer
+// if it wasn't already committed, so an error path here can never leave it dangling.
+func countDay(ctx context.Context, queryDate time.Time) (dayResult, error) {
+	tx, err := pg.BeginEx(ctx, &snapshotTxOptions)
+	if err != nil {
+		return dayResult{}, err
+	}
+	defer tx.Rollback()
+
+	if debug {
+		fmt.Printf("Generating active user data for: %s\n", queryDate.Format("2006-01-02"))
+	}
+
+	counts := make(map[string]int)
+	continentCounts := make(map[string]int)
+	subdivisionCounts := make(map[string]int)
+	asnCounts := make(map[string]int)
+
+	if geo == nil {
+		// Get the active user count for each country, for the queryDate 24 hour period
+		dbQuery := `
+			SELECT client_country, count(client_country)
+			FROM download_log
+			WHERE request_time > $1
+				AND request_time < $2
+				AND request = '/currentrelease'
+				AND client_country IS NOT NULL
+				AND client_country != 'ZZZ'
+				AND client_country != ''
+			GROUP BY client_country
+			ORDER BY client_country ASC`
+		rows, err := tx.Query(dbQuery, queryDate, queryDate.AddDate(0, 0, 1))
+		if err != nil {
+			return dayResult{}, fmt.Errorf("database query failed: %v", err)
+		}
+		for rows.Next() {
+			var countryCode string
+			var userCount int
+			if err = rows.Scan(&countryCode, &userCount); err != nil {
+				rows.Close()
+				return dayResult{}, fmt.Errorf("error reading row data for country count.  Start date = '%s': %v", queryDate.Format(time.RFC822), err)
+			}
+			counts[countryCode] = userCount
+		}
+		rows.Close()
+	} else {
+		// GeoIP enrichment needs the source IP for each row, so fall back to per-row
+		// counting instead of a GROUP BY
+		dbQuery := fmt.Sprintf(`
+			SELECT client_country, %s
+			FROM download_log
+			WHERE request_time > $1
+				AND request_time < $2
+				AND request = '/currentrelease'
+				AND client_country IS NOT NULL
+				AND client_country != 'ZZZ'
+				AND client_country != ''`, Conf.GeoIP.IPColumn)
+		rows, err := tx.Query(dbQuery, queryDate, queryDate.AddDate(0, 0, 1))
+		if err != nil {
+			return dayResult{}, fmt.Errorf("database query failed: %v", err)
+		}
+
+		// Cache lookups for the duration of this day, since the same source IPs tend
+		// to repeat many times within a 24 hour period
+		ipCache, err := lru.New(4096)
+		if err != nil {
+			rows.Close()
+			return dayResult{}, err
+		}
+		for rows.Next() {
+			var countryCode, ipStr string
+			if err = rows.Scan(&countryCode, &ipStr); err != nil {
+				rows.Close()
+				return dayResult{}, fmt.Errorf("error reading row data for country count.  Start date = '%s': %v", queryDate.Format(time.RFC822), err)
+			}
+			counts[countryCode]++
+
+			var g geoLookup
+			if cached, ok := ipCache.Get(ipStr); ok {
+				g = cached.(geoLookup)
+			} else {
+				g, err = geo.lookup(ipStr)
+				if err != nil {
+					// Can't resolve this row's IP; skip its geo rollups rather than
+					// failing the whole day
+					continue
+				}
+				ipCache.Add(ipStr, g)
+			}
+			if g.continent != "" {
+				continentCounts[g.continent]++
+			}
+			if g.subdivision != "" {
+				subdivisionCounts[g.subdivision]++
+			}
+			if g.asn != "" {
+				asnCounts[g.asn]++
+			}
+		}
+		rows.Close()
+	}
+
+	if err = tx.Commit(); err != nil {
+		return dayResult{}, err
+	}
+
+	return dayResult{
+		date:              queryDate,
+		counts:            counts,
+		continentCounts:   continentCounts,
+		subdivisionCounts: subdivisionCounts,
+		asnCounts:         asnCounts,
+	}, nil
+}
+
 func main() {
+	// Command line flags
+	fullRebuild := flag.Bool("full-rebuild", false, "Recompute the entire history instead of resuming from the last run")
+	flag.Parse()
+
 	// Override config file location via environment variables
 	var err error
 	configFile := os.Getenv("CONFIG_FILE")
@@ -59,22 +274,59 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create the SQLite database
-	dbFile := "db4s_country_stats.sqlite"
-	sdb, err = sqlite.Open(dbFile)
+	// Work out whether this run should recompute the full history, or resume from
+	// wherever the previous run left off
+	mode := Conf.Run.Mode
+	if mode == "" {
+		mode = "incremental"
+	}
+	if *fullRebuild {
+		mode = "full"
+	}
+	if debug {
+		fmt.Printf("Run mode: %s\n", mode)
+	}
+
+	// Set up the output store (defaults to a local SQLite database file)
+	if Conf.Output.Driver == "" || Conf.Output.Driver == "sqlite" {
+		if Conf.Output.SQLite.File == "" {
+			Conf.Output.SQLite.File = "db4s_country_stats.sqlite"
+		}
+	}
+	store, err = NewStore(Conf.Output)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ctx := context.Background()
+	if err = store.Init(ctx, mode); err != nil {
+		log.Fatal(err)
+	}
 	defer func() {
-		err = sdb.Close()
+		err = store.Close()
 		if err != nil {
 			log.Println(err)
 		}
 	}()
 
-	// Log successful connection
-	if debug {
-		fmt.Printf("Created country stats database: %v\n", dbFile)
+	// Set up the GeoIP enrichment subsystem, if configured
+	if Conf.GeoIP.Enabled {
+		if Conf.GeoIP.IPColumn == "" {
+			Conf.GeoIP.IPColumn = "client_ip"
+		}
+		geo, err = newGeoIPEnricher(Conf.GeoIP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			err = geo.Close()
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+
+		if debug {
+			fmt.Printf("GeoIP enrichment enabled, using source IP column: %s\n", Conf.GeoIP.IPColumn)
+		}
 	}
 
 	// Setup the PostgreSQL config
@@ -104,18 +356,14 @@ func main() {
 		fmt.Printf("Connected to PostgreSQL server: %v\n", Conf.Pg.Server)
 	}
 
-	// Begin PostgreSQL transaction
-	tx, err := pg.Begin()
+	// Begin a read-only, deferrable, serializable PostgreSQL transaction just long enough
+	// to determine the date range. It's committed below, before the worker pool starts, so
+	// it doesn't permanently pin one of the pool's connections for the rest of the run -
+	// each worker opens its own snapshot transaction instead
+	tx, err := pg.BeginEx(ctx, &snapshotTxOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Set up an automatic transaction roll back if the function exits without committing
-	defer func() {
-		err = tx.Rollback()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
 
 	// Determine start and end dates for the active users data
 	var d, endDate, startDate time.Time
@@ -153,80 +401,100 @@ func main() {
 	}
 	endDate = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
 
-	// Create SQLite tables to hold the active users
-	sQuery := `
-		DROP TABLE IF EXISTS "active_users";	
-		CREATE TABLE IF NOT EXISTS "active_users" (
-			"date"	TEXT,
-			"country"	TEXT,
-			"users"	INTEGER
-		);
-		CREATE INDEX IF NOT EXISTS "active_users-date_idx" ON "active_users" (
-			"date"
-		)`
-	err = sdb.Exec(sQuery)
-	if err != nil {
+	// Done with the date-range snapshot; release the connection back to the pool before
+	// the worker pool below starts checking out its own connections
+	if err = tx.Commit(); err != nil {
 		log.Fatal(err)
 	}
 
-	// Create the SQLite prepared query for inserting the data rows
-	insQuery := `
-		INSERT INTO active_users (date, country, users)
-		VALUES (?, ?, ?)`
-	stmt, err := sdb.Prepare(insQuery)
-	if err != nil {
-		log.Fatal(err)
+	// In incremental mode, resume from the day after the most recent date already in
+	// active_users instead of recomputing the entire history
+	if mode == "incremental" {
+		maxDate, ok, err := store.MaxActiveUsersDate(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ok {
+			startDate = maxDate.AddDate(0, 0, 1)
+			if debug {
+				fmt.Printf("Resuming from: %s\n", startDate.Format(time.RFC822))
+			}
+		}
 	}
-	defer stmt.Finalize()
 
-	// For each 24 hour period, generate country count info & insert it in the SQLite database
+	// Queue up every day in the range for the worker pool to pick up
+	numDays := int(endDate.Sub(startDate).Hours() / 24)
+	if numDays < 0 {
+		numDays = 0
+	}
+	dates := make(chan time.Time, numDays)
 	for queryDate := startDate; queryDate.Before(endDate); queryDate = queryDate.AddDate(0, 0, 1) {
+		dates <- queryDate
+	}
+	close(dates)
 
-		if debug {
-			fmt.Printf("Generating active user data for: %s\n", queryDate.Format("2006-01-02"))
-		}
+	// Fan the per-day queries out across a worker pool, sized by the PostgreSQL
+	// connection pool, each with its own connection and read-only snapshot transaction
+	numWorkers := Conf.Pg.NumConnections
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	results := make(chan dayResult, numWorkers)
+	errCh := make(chan error, numWorkers)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go countWorker(ctx, dates, results, errCh, &wg)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-		// Get the active user count for each country, for the queryDate 24 hour period
-		dbQuery = `
-			SELECT client_country, count(client_country)
-			FROM download_log
-			WHERE request_time > $1
-				AND request_time < $2
-				AND request = '/currentrelease'
-				AND client_country IS NOT NULL
-				AND client_country != 'ZZZ'
-				AND client_country != ''
-			GROUP BY client_country
-			ORDER BY client_country ASC`
-		rows, err := tx.Query(dbQuery, queryDate, queryDate.AddDate(0, 0, 1))
-		if err != nil {
-			log.Fatalf("Database query failed: %v\n", err)
-		}
-		list := make(map[string]int)
-		for rows.Next() {
-			var countryCode string
-			var userCount int
-			err = rows.Scan(&countryCode, &userCount)
-			if err != nil {
-				log.Fatalf("Error reading row data for country count.  Start date = '%s': %v\n", queryDate.Format(time.RFC822), err)
+	// Single writer goroutine drains the results and inserts them into the output store,
+	// so the store only ever sees one writer regardless of how many workers are running
+	writerErr := make(chan error, 1)
+	rowsWritten := make(chan int, 1)
+	go func() {
+		rows := 0
+		for r := range results {
+			if debug {
+				fmt.Printf("Inserting into the output store for: %s\n", r.date.Format("2006-01-02"))
+			}
+			if err := store.InsertDay(r.date, r.counts, r.continentCounts, r.subdivisionCounts, r.asnCounts); err != nil {
+				writerErr <- err
+				return
 			}
-			list[countryCode] = userCount
+			rows += len(r.counts)
 		}
-		rows.Close()
+		rowsWritten <- rows
+		writerErr <- nil
+	}()
 
-		if debug {
-			fmt.Printf("Inserting into SQLite database for: %s\n", queryDate.Format("2006-01-02"))
+	if err = <-writerErr; err != nil {
+		log.Fatal(err)
+	}
+	select {
+	case err = <-errCh:
+		if err != nil {
+			log.Fatal(err)
 		}
+	default:
+	}
 
-		// Save the active users data to the SQLite database
-		for cntry, users := range list {
-			res, err := stmt.ExecDml(queryDate.Format("2006-01-02"), cntry, users)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if res != 1 {
-				log.Fatalf("Inserting into SQLite database returned '%d' instead of 1\n", res)
-			}
+	// Record this run's covered range and row count in run_log, for auditing purposes
+	if err = store.RecordRun(ctx, mode, startDate, endDate, <-rowsWritten); err != nil {
+		log.Fatal(err)
+	}
+
+	// Export the active_users data in any additional formats configured under [export]
+	if Conf.Export.JSONFile != "" || Conf.Export.CSVFile != "" || Conf.Export.PromFile != "" {
+		allRows, err := store.AllActiveUsers(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = exportActiveUsers(allRows, Conf.Export); err != nil {
+			log.Fatal(err)
 		}
 	}
 }
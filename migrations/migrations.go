@@ -0,0 +1,83 @@
+// Package migrations applies versioned schema changes to the SQLite output database, so
+// new columns and tables can land without wiping historical data or requiring users to
+// delete their existing db4s_country_stats.sqlite file.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a single, ordered schema change. Up runs inside its own transaction and
+// must be safe to apply to a database that's never seen it before.
+type Migration struct {
+	ID          int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// All is the ordered list of migrations applied to the output database. New migrations
+// are appended here; existing ones are never edited once shipped.
+var All = []Migration{
+	{
+		ID:          1,
+		Description: "create active_users table and index",
+		Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS "active_users" (
+					"date"	TEXT,
+					"country"	TEXT,
+					"users"	INTEGER
+				);
+				CREATE INDEX IF NOT EXISTS "active_users-date_idx" ON "active_users" (
+					"date"
+				)`)
+			return err
+		},
+	},
+}
+
+// Apply creates the schema_version table if needed, then runs every migration in All
+// that hasn't already been recorded, each inside its own transaction. Callers that want a
+// full rebuild should drop schema_version along with whatever tables they're resetting,
+// so Apply treats the database as unmigrated and reruns everything from migration 1.
+func Apply(db *sql.DB) error {
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "schema_version" (
+			"id"	INTEGER PRIMARY KEY,
+			"description"	TEXT,
+			"applied_at"	TEXT
+		)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM schema_version`).Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range All {
+		if m.ID <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = m.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %v", m.ID, m.Description, err)
+		}
+		if _, err = tx.Exec(`INSERT INTO schema_version (id, description, applied_at) VALUES (?, ?, ?)`,
+			m.ID, m.Description, time.Now().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package migrations
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("opening in-memory sqlite db: %v", err)
+	}
+	return db
+}
+
+func TestApplyCreatesActiveUsersTable(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := Apply(db); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	var name string
+	if err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'active_users'`).Scan(&name); err != nil {
+		t.Fatalf("active_users table not created: %v", err)
+	}
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := Apply(db); err != nil {
+		t.Fatalf("first Apply: %v", err)
+	}
+	if err := Apply(db); err != nil {
+		t.Fatalf("second Apply: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&count); err != nil {
+		t.Fatalf("counting schema_version rows: %v", err)
+	}
+	if count != len(All) {
+		t.Fatalf("schema_version has %d rows after two Apply calls, want %d (migrations shouldn't rerun)", count, len(All))
+	}
+}
+
+// TestApplyRecordsEachMigrationOnceInOrder guards the ordering/bookkeeping contract that
+// callers like sqliteStore.Init depend on: every migration in All is recorded in
+// schema_version exactly once, in ascending ID order.
+func TestApplyRecordsEachMigrationOnceInOrder(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := Apply(db); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	rows, err := db.Query(`SELECT id FROM schema_version ORDER BY id`)
+	if err != nil {
+		t.Fatalf("querying schema_version: %v", err)
+	}
+	defer rows.Close()
+
+	var got []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatalf("scanning schema_version row: %v", err)
+		}
+		got = append(got, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("iterating schema_version rows: %v", err)
+	}
+
+	if len(got) != len(All) {
+		t.Fatalf("schema_version has %d rows, want %d (one per migration in All)", len(got), len(All))
+	}
+	for i, m := range All {
+		if got[i] != m.ID {
+			t.Fatalf("schema_version row %d has id %d, want %d (migrations must run in ascending ID order)", i, got[i], m.ID)
+		}
+	}
+}
+
+// TestApplySkipsAlreadyRecordedMigrationsEvenIfTheirTablesAreGone documents the flip side
+// of idempotency: Apply decides what to run purely from schema_version, not from whether
+// a migration's tables still exist. A caller that wants a migration to rerun (e.g. a
+// full-rebuild that drops active_users) must also clear schema_version itself; Apply has
+// no way to know the drop happened.
+func TestApplySkipsAlreadyRecordedMigrationsEvenIfTheirTablesAreGone(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := Apply(db); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, err := db.Exec(`DROP TABLE "active_users"`); err != nil {
+		t.Fatalf("dropping active_users: %v", err)
+	}
+
+	if err := Apply(db); err != nil {
+		t.Fatalf("Apply after drop: %v", err)
+	}
+
+	if err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'active_users'`).Scan(new(string)); err == nil {
+		t.Fatalf("active_users was recreated without resetting schema_version; migration 1 should have been skipped as already applied")
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/justinclift/db4s_country_stats_generator/migrations"
+)
+
+// Store is the interface implemented by each supported output backend.  It owns the
+// destination database for the generated stats: opening/creating it, writing the
+// per-day active user counts, and closing it down again once the run finishes.
+type Store interface {
+	// Init prepares the destination database for writing (opening the connection and
+	// creating any tables it needs).  mode is "full" or "incremental"; in "full" mode the
+	// existing active_users table (if any) is dropped and recreated from scratch.
+	Init(ctx context.Context, mode string) error
+
+	// MaxActiveUsersDate returns the most recent date already present in active_users, so
+	// an incremental run knows where to resume from. ok is false if the table is empty.
+	MaxActiveUsersDate(ctx context.Context) (date time.Time, ok bool, err error)
+
+	// InsertDay writes the per-country active_users counts for a single day, plus the
+	// continent/subdivision/ASN GeoIP rollups (empty maps if GeoIP enrichment is disabled
+	// or didn't resolve anything that day), as a single atomic unit. That way a failure
+	// partway through never leaves the rollup tables out of step with active_users for a
+	// date MaxActiveUsersDate considers already complete.
+	InsertDay(date time.Time, counts, continentCounts, subdivisionCounts, asnCounts map[string]int) error
+
+	// AllActiveUsers returns every row of the active_users table, ordered by date then
+	// country, for the export subsystem to write out in other formats
+	AllActiveUsers(ctx context.Context) ([]ActiveUserRow, error)
+
+	// RecordRun appends a row to run_log describing the date range and row count a run
+	// covered, as a history of runs for auditing purposes
+	RecordRun(ctx context.Context, mode string, startDate, endDate time.Time, rows int) error
+
+	// Close releases any resources (connections, file handles, etc) held by the store
+	Close() error
+}
+
+// NewStore constructs the Store implementation selected by the [output] driver setting
+func NewStore(conf OutputInfo) (Store, error) {
+	switch conf.Driver {
+	case "", "sqlite":
+		return &sqliteStore{file: conf.SQLite.File}, nil
+	case "postgres":
+		return &pgStore{conf: conf.Postgres}, nil
+	case "mysql":
+		return &mysqlStore{conf: conf.MySQL}, nil
+	}
+	return nil, fmt.Errorf("unknown output driver: %s", conf.Driver)
+}
+
+// execCounts runs a prepared (date, key, users) insert statement once per entry in
+// counts. It's shared by the GeoIP rollup inserts across all three backends, since their
+// shape is identical to active_users, just keyed by continent/subdivision/ASN instead of
+// country.
+func execCounts(stmt *sql.Stmt, date time.Time, counts map[string]int) error {
+	for key, users := range counts {
+		if _, err := stmt.Exec(date.Format("2006-01-02"), key, users); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropIfFullRebuild prepends a DROP TABLE IF EXISTS for quotedTable to createSQL when mode
+// is "full", so a full rebuild starts that table from scratch instead of appending to
+// whatever it already contains; otherwise createSQL is returned unchanged. Shared by all
+// three backends' Init, for both active_users and the GeoIP rollup tables, so the drop
+// logic can't drift out of sync between them as new tables are added.
+func dropIfFullRebuild(mode, quotedTable, createSQL string) string {
+	if mode != "full" {
+		return createSQL
+	}
+	return fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, quotedTable) + createSQL
+}
+
+// insertDayTx runs the active_users insert plus the continent/subdivision/ASN rollup
+// inserts for a single day inside one transaction, committing only if every insert
+// succeeds. It's shared by pgStore and mysqlStore, since neither of them already has a
+// run-long transaction backing their prepared statements the way sqliteStore does.
+func insertDayTx(db *sql.DB, ins, insByContinent, insBySubdivision, insByASN *sql.Stmt, date time.Time, counts, continentCounts, subdivisionCounts, asnCounts map[string]int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := execCounts(tx.Stmt(ins), date, counts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := execCounts(tx.Stmt(insByContinent), date, continentCounts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := execCounts(tx.Stmt(insBySubdivision), date, subdivisionCounts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := execCounts(tx.Stmt(insByASN), date, asnCounts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanActiveUserRows drains a (date, country, users) result set into ActiveUserRows. It's
+// shared by all three backends since the row shape is identical.
+func scanActiveUserRows(rows *sql.Rows) ([]ActiveUserRow, error) {
+	defer rows.Close()
+	var result []ActiveUserRow
+	for rows.Next() {
+		var r ActiveUserRow
+		if err := rows.Scan(&r.Date, &r.Country, &r.Users); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// runLogSchemaSQLite is the SQLite run_log table definition; pgStore and mysqlStore
+// create their own equivalents in their Init.  It's never dropped, so it keeps a full
+// audit history of runs across the life of the output database.
+const runLogSchemaSQLite = `
+	CREATE TABLE IF NOT EXISTS "run_log" (
+		"id"	INTEGER PRIMARY KEY AUTOINCREMENT,
+		"mode"	TEXT,
+		"start_date"	TEXT,
+		"end_date"	TEXT,
+		"rows"	INTEGER,
+		"finished_at"	TEXT
+	)`
+
+// sqliteStore writes the active user stats to a local SQLite database file.  All of the
+// per-day inserts for a run are wrapped in a single transaction, committed on Close, so
+// a multi-year run doesn't pay a fsync per row.
+type sqliteStore struct {
+	file             string
+	db               *sql.DB
+	tx               *sql.Tx
+	ins              *sql.Stmt
+	insByContinent   *sql.Stmt
+	insBySubdivision *sql.Stmt
+	insByASN         *sql.Stmt
+}
+
+func (s *sqliteStore) Init(ctx context.Context, mode string) error {
+	db, err := sql.Open("sqlite3", s.file)
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	if debug {
+		fmt.Printf("Created country stats database: %v\n", s.file)
+	}
+
+	// In full-rebuild mode, drop the existing active_users table and schema_version
+	// together, so migrations.Apply below sees a database it's never touched and reruns
+	// every migration from scratch. Dropping active_users alone isn't enough: Apply skips
+	// any migration already recorded in schema_version, so migration 1 (which creates
+	// active_users) would never rerun and leave the table permanently missing.
+	if mode == "full" {
+		if _, err = s.db.ExecContext(ctx, `DROP TABLE IF EXISTS "active_users"`); err != nil {
+			return err
+		}
+		if _, err = s.db.ExecContext(ctx, `DROP TABLE IF EXISTS "schema_version"`); err != nil {
+			return err
+		}
+	}
+	if err = migrations.Apply(s.db); err != nil {
+		return err
+	}
+
+	if _, err = s.db.ExecContext(ctx, runLogSchemaSQLite); err != nil {
+		return err
+	}
+	for _, geoTable := range []string{"continent", "subdivision", "asn"} {
+		geoSQL := fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS "active_users_by_%[1]s" (
+				"date"	TEXT,
+				"%[1]s"	TEXT,
+				"users"	INTEGER
+			);
+			CREATE INDEX IF NOT EXISTS "active_users_by_%[1]s-date_idx" ON "active_users_by_%[1]s" (
+				"date"
+			)`, geoTable)
+		geoSQL = dropIfFullRebuild(mode, fmt.Sprintf(`"active_users_by_%s"`, geoTable), geoSQL)
+		if _, err = s.db.ExecContext(ctx, geoSQL); err != nil {
+			return err
+		}
+	}
+
+	s.tx, err = s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	s.ins, err = s.tx.PrepareContext(ctx, `INSERT INTO active_users (date, country, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insByContinent, err = s.tx.PrepareContext(ctx, `INSERT INTO active_users_by_continent (date, continent, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insBySubdivision, err = s.tx.PrepareContext(ctx, `INSERT INTO active_users_by_subdivision (date, subdivision, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insByASN, err = s.tx.PrepareContext(ctx, `INSERT INTO active_users_by_asn (date, asn, users) VALUES (?, ?, ?)`)
+	return err
+}
+
+func (s *sqliteStore) MaxActiveUsersDate(ctx context.Context) (time.Time, bool, error) {
+	var maxDate sql.NullString
+	if err := s.tx.QueryRowContext(ctx, `SELECT MAX(date) FROM active_users`).Scan(&maxDate); err != nil {
+		return time.Time{}, false, err
+	}
+	if !maxDate.Valid {
+		return time.Time{}, false, nil
+	}
+	date, err := time.Parse("2006-01-02", maxDate.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return date, true, nil
+}
+
+// InsertDay writes all four tables for the day using the prepared statements bound to
+// the run-long transaction from Init, so they're already atomic with the rest of the run
+// without needing a transaction of their own here.
+func (s *sqliteStore) InsertDay(date time.Time, counts, continentCounts, subdivisionCounts, asnCounts map[string]int) error {
+	for cntry, users := range counts {
+		res, err := s.ins.Exec(date.Format("2006-01-02"), cntry, users)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return fmt.Errorf("inserting into SQLite database returned '%d' instead of 1", n)
+		}
+	}
+	if err := execCounts(s.insByContinent, date, continentCounts); err != nil {
+		return err
+	}
+	if err := execCounts(s.insBySubdivision, date, subdivisionCounts); err != nil {
+		return err
+	}
+	return execCounts(s.insByASN, date, asnCounts)
+}
+
+func (s *sqliteStore) AllActiveUsers(ctx context.Context) ([]ActiveUserRow, error) {
+	rows, err := s.tx.QueryContext(ctx, `SELECT date, country, users FROM active_users ORDER BY date, country`)
+	if err != nil {
+		return nil, err
+	}
+	return scanActiveUserRows(rows)
+}
+
+func (s *sqliteStore) RecordRun(ctx context.Context, mode string, startDate, endDate time.Time, rows int) error {
+	_, err := s.tx.ExecContext(ctx, `
+		INSERT INTO run_log (mode, start_date, end_date, rows, finished_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		mode, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), rows, time.Now().Format(time.RFC3339))
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.ins, s.insByContinent, s.insBySubdivision, s.insByASN} {
+		if stmt != nil {
+			if err := stmt.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.tx != nil {
+		if err := s.tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return s.db.Close()
+}
+
+// pgStore writes the active user stats to a PostgreSQL database
+type pgStore struct {
+	conf             PostgresDSN
+	db               *sql.DB
+	ins              *sql.Stmt
+	insByContinent   *sql.Stmt
+	insBySubdivision *sql.Stmt
+	insByASN         *sql.Stmt
+}
+
+func (s *pgStore) Init(ctx context.Context, mode string) error {
+	sslMode := "disable"
+	if s.conf.SSL {
+		sslMode = "require"
+	}
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		s.conf.Server, s.conf.Port, s.conf.Username, s.conf.Password, s.conf.Database, sslMode)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	if debug {
+		fmt.Printf("Connected to output PostgreSQL server: %v\n", s.conf.Server)
+	}
+
+	activeUsersSQL := dropIfFullRebuild(mode, "active_users", `
+		CREATE TABLE IF NOT EXISTS active_users (
+			date	date,
+			country	text,
+			users	integer
+		);
+		CREATE INDEX IF NOT EXISTS active_users_date_idx ON active_users (date)`)
+	if _, err = s.db.ExecContext(ctx, activeUsersSQL); err != nil {
+		return err
+	}
+	runLogSQL := `
+		CREATE TABLE IF NOT EXISTS run_log (
+			id	serial PRIMARY KEY,
+			mode	text,
+			start_date	date,
+			end_date	date,
+			rows	integer,
+			finished_at	timestamptz
+		)`
+	if _, err = s.db.ExecContext(ctx, runLogSQL); err != nil {
+		return err
+	}
+	for _, geoTable := range []string{"continent", "subdivision", "asn"} {
+		geoSQL := fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS active_users_by_%[1]s (
+				date	date,
+				%[1]s	text,
+				users	integer
+			);
+			CREATE INDEX IF NOT EXISTS active_users_by_%[1]s_date_idx ON active_users_by_%[1]s (date)`, geoTable)
+		geoSQL = dropIfFullRebuild(mode, fmt.Sprintf("active_users_by_%s", geoTable), geoSQL)
+		if _, err = s.db.ExecContext(ctx, geoSQL); err != nil {
+			return err
+		}
+	}
+
+	s.ins, err = s.db.PrepareContext(ctx, `INSERT INTO active_users (date, country, users) VALUES ($1, $2, $3)`)
+	if err != nil {
+		return err
+	}
+	s.insByContinent, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_continent (date, continent, users) VALUES ($1, $2, $3)`)
+	if err != nil {
+		return err
+	}
+	s.insBySubdivision, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_subdivision (date, subdivision, users) VALUES ($1, $2, $3)`)
+	if err != nil {
+		return err
+	}
+	s.insByASN, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_asn (date, asn, users) VALUES ($1, $2, $3)`)
+	return err
+}
+
+func (s *pgStore) MaxActiveUsersDate(ctx context.Context) (time.Time, bool, error) {
+	var maxDate sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT MAX(date)::text FROM active_users`).Scan(&maxDate); err != nil {
+		return time.Time{}, false, err
+	}
+	if !maxDate.Valid {
+		return time.Time{}, false, nil
+	}
+	date, err := time.Parse("2006-01-02", maxDate.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return date, true, nil
+}
+
+func (s *pgStore) InsertDay(date time.Time, counts, continentCounts, subdivisionCounts, asnCounts map[string]int) error {
+	return insertDayTx(s.db, s.ins, s.insByContinent, s.insBySubdivision, s.insByASN, date, counts, continentCounts, subdivisionCounts, asnCounts)
+}
+
+func (s *pgStore) AllActiveUsers(ctx context.Context) ([]ActiveUserRow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT date::text, country, users FROM active_users ORDER BY date, country`)
+	if err != nil {
+		return nil, err
+	}
+	return scanActiveUserRows(rows)
+}
+
+func (s *pgStore) RecordRun(ctx context.Context, mode string, startDate, endDate time.Time, rows int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO run_log (mode, start_date, end_date, rows, finished_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		mode, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), rows, time.Now())
+	return err
+}
+
+func (s *pgStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.ins, s.insByContinent, s.insBySubdivision, s.insByASN} {
+		if stmt != nil {
+			if err := stmt.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.db.Close()
+}
+
+// mysqlStore writes the active user stats to a MySQL database
+type mysqlStore struct {
+	conf             MySQLInfo
+	db               *sql.DB
+	ins              *sql.Stmt
+	insByContinent   *sql.Stmt
+	insBySubdivision *sql.Stmt
+	insByASN         *sql.Stmt
+}
+
+func (s *mysqlStore) Init(ctx context.Context, mode string) error {
+	// multiStatements=true is required because in full mode Init below issues the DROP
+	// TABLE and CREATE TABLE for each table as one multi-statement exec;
+	// go-sql-driver/mysql rejects those by default
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?multiStatements=true", s.conf.Username, s.conf.Password, s.conf.Server, s.conf.Port, s.conf.Database)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	if debug {
+		fmt.Printf("Connected to output MySQL server: %v\n", s.conf.Server)
+	}
+
+	activeUsersSQL := dropIfFullRebuild(mode, "active_users", `
+		CREATE TABLE IF NOT EXISTS active_users (
+			date	DATE,
+			country	VARCHAR(3),
+			users	INT,
+			INDEX active_users_date_idx (date)
+		)`)
+	if _, err = s.db.ExecContext(ctx, activeUsersSQL); err != nil {
+		return err
+	}
+	runLogSQL := `
+		CREATE TABLE IF NOT EXISTS run_log (
+			id	INT AUTO_INCREMENT PRIMARY KEY,
+			mode	VARCHAR(16),
+			start_date	DATE,
+			end_date	DATE,
+			rows	INT,
+			finished_at	DATETIME
+		)`
+	if _, err = s.db.ExecContext(ctx, runLogSQL); err != nil {
+		return err
+	}
+	for _, geoTable := range []string{"continent", "subdivision", "asn"} {
+		geoSQL := fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS active_users_by_%[1]s (
+				date	DATE,
+				%[1]s	VARCHAR(32),
+				users	INT,
+				INDEX active_users_by_%[1]s_date_idx (date)
+			)`, geoTable)
+		geoSQL = dropIfFullRebuild(mode, fmt.Sprintf("active_users_by_%s", geoTable), geoSQL)
+		if _, err = s.db.ExecContext(ctx, geoSQL); err != nil {
+			return err
+		}
+	}
+
+	s.ins, err = s.db.PrepareContext(ctx, `INSERT INTO active_users (date, country, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insByContinent, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_continent (date, continent, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insBySubdivision, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_subdivision (date, subdivision, users) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	s.insByASN, err = s.db.PrepareContext(ctx, `INSERT INTO active_users_by_asn (date, asn, users) VALUES (?, ?, ?)`)
+	return err
+}
+
+func (s *mysqlStore) MaxActiveUsersDate(ctx context.Context) (time.Time, bool, error) {
+	var maxDate sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT MAX(date) FROM active_users`).Scan(&maxDate); err != nil {
+		return time.Time{}, false, err
+	}
+	if !maxDate.Valid {
+		return time.Time{}, false, nil
+	}
+	date, err := time.Parse("2006-01-02", maxDate.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return date, true, nil
+}
+
+func (s *mysqlStore) InsertDay(date time.Time, counts, continentCounts, subdivisionCounts, asnCounts map[string]int) error {
+	return insertDayTx(s.db, s.ins, s.insByContinent, s.insBySubdivision, s.insByASN, date, counts, continentCounts, subdivisionCounts, asnCounts)
+}
+
+func (s *mysqlStore) AllActiveUsers(ctx context.Context) ([]ActiveUserRow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DATE_FORMAT(date, '%Y-%m-%d'), country, users FROM active_users ORDER BY date, country`)
+	if err != nil {
+		return nil, err
+	}
+	return scanActiveUserRows(rows)
+}
+
+func (s *mysqlStore) RecordRun(ctx context.Context, mode string, startDate, endDate time.Time, rows int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO run_log (mode, start_date, end_date, rows, finished_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		mode, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), rows, time.Now())
+	return err
+}
+
+func (s *mysqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.ins, s.insByContinent, s.insBySubdivision, s.insByASN} {
+		if stmt != nil {
+			if err := stmt.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.db.Close()
+}